@@ -2,6 +2,19 @@
 //
 // Changes made:
 // - Discover to discover PATH as well.
+// - Discover/discoverSingle split PATH with filepath.SplitList and glob for
+//   the platform executable extension (e.g. ".exe" on Windows) instead of
+//   hard-coding the Unix ":" separator and trimming everything after the
+//   first "." in a plugin's filename.
+// - Discover now delegates to a pluggable list of PluginSource backends
+//   (see plugin_source.go) instead of always walking the filesystem.
+// - FileSource globs its candidate directories concurrently across a
+//   bounded worker pool, merging results in documented precedence order,
+//   and Config.DiscoverTimeout bounds how long that can take.
+// - Discovery and factory diagnostics are routed through a pluggable
+//   Logger (Config.Logger) instead of direct stdlib log calls and stray
+//   fmt.Println calls, so embedders can silence or redirect them. The
+//   default Logger still writes through the stdlib log package.
 
 package libterraform
 
@@ -12,7 +25,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/terraform/plugin"
@@ -20,6 +36,53 @@ import (
 	"github.com/kardianos/osext"
 )
 
+// executableExtension is the file extension appended to plugin binaries on
+// the current platform, e.g. ".exe" on Windows. It is used both to build
+// the glob patterns passed to discoverSingle and to strip the extension
+// back off before parsing the plugin name.
+var executableExtension = func() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}()
+
+const (
+	providerPrefix    = "terraform-provider-"
+	provisionerPrefix = "terraform-provisioner-"
+)
+
+// Logger is the logging contract used for discovery and factory
+// diagnostics. Config.Logger defaults to stdLogger, a thin wrapper around
+// the stdlib log package this file already used directly, so embedders
+// that don't want libterraform writing to stdout/stderr (e.g. servers
+// where stdout carries protocol data) can supply their own.
+//
+// Implementations must be safe for concurrent use: discoverDirs calls a
+// Config's Logger from multiple goroutines while globbing directories in
+// parallel.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger is the default Logger, preserving this file's historical
+// "[DEBUG]"/"[ERR]" prefix convention.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("[DEBUG] "+format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("[INFO] "+format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("[ERR] "+format, args...)
+}
+
 // Config is the structure of the configuration for the Terraform CLI.
 //
 // This is not the configuration for Terraform itself. That is in the
@@ -30,6 +93,28 @@ type Config struct {
 
 	DisableCheckpoint          bool `hcl:"disable_checkpoint"`
 	DisableCheckpointSignature bool `hcl:"disable_checkpoint_signature"`
+
+	// DiscoverTimeout bounds how long Discover (and in particular
+	// FileSource's concurrent directory globbing) is allowed to run
+	// before giving up with an error. Zero means no timeout, matching
+	// the historical, possibly-unbounded behavior.
+	DiscoverTimeout time.Duration
+
+	// Logger receives discovery and factory diagnostics. If nil, it
+	// defaults to stdLogger, which logs through the stdlib log package.
+	Logger Logger
+
+	// sources are the PluginSources that Discover queries, in the order
+	// added via AddSource. If empty, Discover falls back to a FileSource.
+	sources []PluginSource
+}
+
+// logger returns c.Logger, defaulting to stdLogger if unset.
+func (c *Config) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return stdLogger{}
 }
 
 // BuiltinConfig is the built-in defaults for the configuration. These
@@ -66,35 +151,34 @@ func LoadConfig(path string) (*Config, error) {
 
 // Discover discovers plugins.
 //
-// This looks in the directory of the CWD, the executable and PATH, in that
-// order for priority.
+// It runs each PluginSource registered with AddSource, in the order they
+// were added, and merges what they find into Providers/Provisioners. If no
+// sources have been registered, it defaults to a FileSource, which looks in
+// the directory of the CWD, the executable and PATH, in that order for
+// priority.
 func (c *Config) Discover() error {
-	// Look in the cwd.
-	if err := c.discover("."); err != nil {
-		return err
+	sources := c.sources
+	if len(sources) == 0 {
+		sources = []PluginSource{&FileSource{}}
 	}
 
-	// Next, look in the same directory as the executable. Any conflicts
-	// will overwrite those found in our current directory.
-	exePath, err := osext.Executable()
-	if err != nil {
-		log.Printf("[ERR] Error loading exe directory: %s", err)
-	} else {
-		if err := c.discover(filepath.Dir(exePath)); err != nil {
+	for _, source := range sources {
+		if err := source.Discover(c); err != nil {
 			return err
 		}
 	}
 
-	// Look in the PATH
-	paths := os.Getenv("PATH")
-	for _, p := range strings.Split(paths, ":") {
-		if err := c.discover(p); err != nil {
-			return err
-		}
-	}
 	return nil
 }
 
+// AddSource registers an additional PluginSource for Discover to query,
+// in the order added. Registering a source disables the implicit default
+// FileSource, so callers that still want filesystem discovery alongside
+// e.g. a registry must add a FileSource explicitly.
+func (c *Config) AddSource(s PluginSource) {
+	c.sources = append(c.sources, s)
+}
+
 // Merge merges two configurations and returns a third entirely
 // new configuration with the two merged.
 func (c1 *Config) Merge(c2 *Config) *Config {
@@ -117,60 +201,179 @@ func (c1 *Config) Merge(c2 *Config) *Config {
 	return &result
 }
 
-func (c *Config) discover(path string) error {
-	var err error
+// dirResult is one worker's findings for a single directory passed to
+// discoverDirs, tagged with its index so results can be merged back in
+// the caller's precedence order regardless of completion order.
+type dirResult struct {
+	index        int
+	providers    map[string]string
+	provisioners map[string]string
+	err          error
+}
+
+// discoverDirFunc does the actual per-directory globbing for discoverDirs.
+// It's a package variable rather than a direct call to discoverDir so
+// tests can substitute a slow stand-in to exercise c.DiscoverTimeout
+// without relying on a genuinely slow filesystem.
+var discoverDirFunc = discoverDir
+
+// discoverDirs globs dirs for plugins concurrently across a bounded worker
+// pool, then merges the results into c.Providers/c.Provisioners in the
+// order dirs were given: entries found in a later directory overwrite
+// same-named entries from an earlier one. Callers are expected to pass
+// dirs already in the documented precedence order (lowest priority first),
+// e.g. CWD, then the executable's directory, then PATH left-to-right.
+//
+// If c.DiscoverTimeout is non-zero and discovery doesn't finish within it,
+// discoverDirs returns an error rather than blocking startup indefinitely
+// on a slow or hung filesystem.
+func (c *Config) discoverDirs(dirs []string) error {
+	logger := c.logger()
+
+	workers := runtime.NumCPU()
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan dirResult, len(dirs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				providers, provisioners, err := discoverDirFunc(dirs[idx], logger)
+				results <- dirResult{idx, providers, provisioners, err}
+			}
+		}()
+	}
 
+	go func() {
+		for i := range dirs {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var timeout <-chan time.Time
+	if c.DiscoverTimeout > 0 {
+		timer := time.NewTimer(c.DiscoverTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	ordered := make([]dirResult, len(dirs))
+	for received := 0; received < len(dirs); received++ {
+		select {
+		case res := <-results:
+			ordered[res.index] = res
+		case <-timeout:
+			return fmt.Errorf(
+				"timed out after %s discovering plugins", c.DiscoverTimeout)
+		}
+	}
+
+	for _, res := range ordered {
+		if res.err != nil {
+			return res.err
+		}
+
+		if c.Providers == nil {
+			c.Providers = make(map[string]string)
+		}
+		for k, v := range res.providers {
+			c.Providers[k] = v
+		}
+
+		if c.Provisioners == nil {
+			c.Provisioners = make(map[string]string)
+		}
+		for k, v := range res.provisioners {
+			c.Provisioners[k] = v
+		}
+	}
+
+	return nil
+}
+
+// discoverDir globs a single directory for providers and provisioners.
+func discoverDir(path string, logger Logger) (providers, provisioners map[string]string, err error) {
 	if !filepath.IsAbs(path) {
 		path, err = filepath.Abs(path)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	err = c.discoverSingle(
-		filepath.Join(path, "terraform-provider-*"), &c.Providers)
+	providers, err = discoverSingle(
+		filepath.Join(path, providerPrefix+"*"+executableExtension), logger)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	err = c.discoverSingle(
-		filepath.Join(path, "terraform-provisioner-*"), &c.Provisioners)
+	provisioners, err = discoverSingle(
+		filepath.Join(path, provisionerPrefix+"*"+executableExtension), logger)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	return providers, provisioners, nil
 }
 
-func (c *Config) discoverSingle(glob string, m *map[string]string) error {
+func discoverSingle(glob string, logger Logger) (map[string]string, error) {
 	matches, err := filepath.Glob(glob)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if *m == nil {
-		*m = make(map[string]string)
+	m := make(map[string]string)
+	for _, match := range matches {
+		name, ok := pluginName(filepath.Base(match))
+		if !ok {
+			continue
+		}
+
+		logger.Debugf("Discovered plugin: %s = %s", name, match)
+		m[name] = match
 	}
 
-	for _, match := range matches {
-		file := filepath.Base(match)
+	return m, nil
+}
 
-		// If the filename has a ".", trim up to there
-		if idx := strings.Index(file, "."); idx >= 0 {
-			file = file[:idx]
-		}
+// pluginName extracts the plugin name from a plugin binary's filename,
+// e.g. "terraform-provider-aws" (or "terraform-provider-aws.exe" on
+// Windows) becomes "aws". It returns false if file doesn't start with
+// providerPrefix or provisionerPrefix.
+func pluginName(file string) (string, bool) {
+	// Strip the platform executable extension, if any, rather than
+	// blindly trimming everything after the first ".". Plugin base
+	// names can legitimately contain dots (e.g. versioned binaries
+	// like "terraform-provider-aws_v1.2.3").
+	if executableExtension != "" {
+		file = strings.TrimSuffix(file, executableExtension)
+	}
 
-		// Look for foo-bar-baz. The plugin name is "baz"
-		parts := strings.SplitN(file, "-", 3)
-		if len(parts) != 3 {
-			continue
-		}
+	if !strings.HasPrefix(file, providerPrefix) && !strings.HasPrefix(file, provisionerPrefix) {
+		return "", false
+	}
 
-		log.Printf("[DEBUG] Discovered plugin: %s = %s", parts[2], match)
-		(*m)[parts[2]] = match
+	// Look for foo-bar-baz. The plugin name is "baz"
+	parts := strings.SplitN(file, "-", 3)
+	if len(parts) != 3 {
+		return "", false
 	}
 
-	return nil
+	return parts[2], true
 }
 
 // ProviderFactories returns the mapping of prefixes to
@@ -178,9 +381,9 @@ func (c *Config) discoverSingle(glob string, m *map[string]string) error {
 // binary-based plugin.
 func (c *Config) ProviderFactories() map[string]terraform.ResourceProviderFactory {
 	result := make(map[string]terraform.ResourceProviderFactory)
-	fmt.Println("provider factory: ", c.Providers)
+	logger := c.logger()
 	for k, v := range c.Providers {
-		fmt.Println("provider factory: ", k, v)
+		logger.Debugf("Provider factory: %s = %s", k, v)
 		result[k] = c.providerFactory(v)
 	}
 
@@ -0,0 +1,159 @@
+package libterraform
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// benchDiscoverDirs creates n temporary directories, each containing a
+// handful of fake plugin binaries, suitable for exercising discoverDirs.
+// It returns the directories and a cleanup func the caller must defer.
+func benchDiscoverDirs(b *testing.B, n int) (dirs []string, cleanup func()) {
+	dirs = make([]string, n)
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "libterraform-bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, name := range []string{
+			providerPrefix + "aws",
+			providerPrefix + "google",
+			provisionerPrefix + "local-exec",
+		} {
+			path := filepath.Join(dir, name+executableExtension)
+			if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		dirs[i] = dir
+	}
+
+	return dirs, func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func BenchmarkDiscoverDirs(b *testing.B) {
+	dirs, cleanup := benchDiscoverDirs(b, runtime.NumCPU())
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var c Config
+		if err := c.discoverDirs(dirs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiscoverDirsLongPath(b *testing.B) {
+	dirs, cleanup := benchDiscoverDirs(b, 64)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var c Config
+		if err := c.discoverDirs(dirs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// touch creates an empty file at path, failing t if it can't.
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDiscoverDirsPrecedence guards the documented merge order against a
+// regression in the concurrent worker pool (e.g. an off-by-one in
+// ordered[res.index], or merging in completion order instead of dirs
+// order): a name present in more than one directory must resolve to the
+// last directory's copy, while a name unique to an earlier directory must
+// survive being merged with later ones.
+func TestDiscoverDirsPrecedence(t *testing.T) {
+	dirs := make([]string, 3)
+	for i := range dirs {
+		dir, err := ioutil.TempDir("", "libterraform-precedence")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs[i] = dir
+	}
+
+	for _, dir := range dirs {
+		touch(t, filepath.Join(dir, providerPrefix+"shared"+executableExtension))
+	}
+	touch(t, filepath.Join(dirs[0], providerPrefix+"only-first"+executableExtension))
+
+	var c Config
+	if err := c.discoverDirs(dirs); err != nil {
+		t.Fatal(err)
+	}
+
+	wantShared := filepath.Join(dirs[2], providerPrefix+"shared"+executableExtension)
+	if got := c.Providers["shared"]; got != wantShared {
+		t.Errorf(`Providers["shared"] = %q, want %q (last dir should win)`, got, wantShared)
+	}
+
+	wantOnlyFirst := filepath.Join(dirs[0], providerPrefix+"only-first"+executableExtension)
+	if got := c.Providers["only-first"]; got != wantOnlyFirst {
+		t.Errorf(`Providers["only-first"] = %q, want %q`, got, wantOnlyFirst)
+	}
+}
+
+// TestDiscoverDirsTimeout exercises the case <-timeout branch: it swaps
+// discoverDirFunc for a stand-in that blocks indefinitely, so a real slow
+// filesystem isn't needed to prove DiscoverTimeout actually bounds
+// discoverDirs rather than just documenting that it should.
+func TestDiscoverDirsTimeout(t *testing.T) {
+	orig := discoverDirFunc
+	defer func() { discoverDirFunc = orig }()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	discoverDirFunc = func(path string, logger Logger) (map[string]string, map[string]string, error) {
+		<-unblock
+		return nil, nil, nil
+	}
+
+	c := Config{DiscoverTimeout: 10 * time.Millisecond}
+	if err := c.discoverDirs([]string{"unused"}); err == nil {
+		t.Fatal("discoverDirs() with a hung directory succeeded, want a timeout error")
+	}
+}
+
+func TestPluginName(t *testing.T) {
+	cases := []struct {
+		file string
+		name string
+		ok   bool
+	}{
+		{"terraform-provider-aws" + executableExtension, "aws", true},
+		{"terraform-provisioner-local-exec" + executableExtension, "local-exec", true},
+		// A dotted base name, e.g. a versioned binary, must not be
+		// truncated at the first ".".
+		{"terraform-provider-aws_v1.2.3" + executableExtension, "aws_v1.2.3", true},
+		{"not-a-plugin", "", false},
+		{"terraform-provider", "", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		name, ok := pluginName(c.file)
+		if ok != c.ok || name != c.name {
+			t.Errorf("pluginName(%q) = %q, %v; want %q, %v", c.file, name, ok, c.name, c.ok)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package libterraform
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kardianos/osext"
+)
+
+// PluginSource discovers Terraform plugins and registers any it finds into
+// the given Config's Providers/Provisioners maps. Config.Discover runs each
+// source added via Config.AddSource, in order; if none have been added it
+// falls back to a FileSource.
+type PluginSource interface {
+	Discover(c *Config) error
+}
+
+// FileSource discovers plugins on the local filesystem: the current working
+// directory, the directory of the running executable, and PATH, in that
+// order for priority. This is the behavior Config.Discover used before
+// PluginSource existed, and is the implicit default when no source has
+// been added with Config.AddSource.
+//
+// The candidate directories are globbed concurrently across a bounded
+// worker pool (see Config.discoverDirs) and merged back in the precedence
+// order above, so a long PATH or a network-mounted directory is bounded
+// by roughly len(dirs)/runtime.NumCPU() slow entries in sequence rather
+// than all of them.
+type FileSource struct{}
+
+// Discover implements PluginSource.
+func (s *FileSource) Discover(c *Config) error {
+	dirs := []string{"."}
+
+	// Next, look in the same directory as the executable. Any conflicts
+	// will overwrite those found in our current directory.
+	exePath, err := osext.Executable()
+	if err != nil {
+		c.logger().Errorf("Error loading exe directory: %s", err)
+	} else {
+		dirs = append(dirs, filepath.Dir(exePath))
+	}
+
+	// Look in the PATH, left-to-right; later entries overwrite earlier
+	// ones on conflict.
+	dirs = append(dirs, filepath.SplitList(os.Getenv("PATH"))...)
+
+	return c.discoverDirs(dirs)
+}
+
+// RegistrySource discovers plugins from an HTTP(S) registry. It fetches a
+// checksums manifest from ChecksumsURL (lines of "<sha256>  <filename>",
+// matching the output of sha256sum), verifies the manifest against an
+// Ed25519 detached signature fetched from SignatureURL before trusting a
+// single line of it, downloads any
+// "terraform-provider-*"/"terraform-provisioner-*" binaries it lists from
+// BaseURL into CacheDir, verifies each download against its manifest
+// checksum, and registers the cached copies into
+// Config.Providers/Config.Provisioners. Binaries already present in
+// CacheDir with a matching checksum are not re-downloaded.
+//
+// The checksum alone only proves a binary matches the manifest; it says
+// nothing about who produced the manifest. The signature check is what
+// makes BaseURL/ChecksumsURL safe to point at a registry an attacker might
+// be able to serve from or sit in front of (e.g. via DNS/MITM): without a
+// valid signature from PublicKey, Discover refuses to trust the manifest
+// at all.
+type RegistrySource struct {
+	// BaseURL is the base of the registry to fetch plugin binaries from,
+	// e.g. "https://plugins.example.com/terraform/linux_amd64". Binary
+	// names from the checksums manifest are appended to it directly.
+	BaseURL string
+
+	// ChecksumsURL is the location of the SHA256 manifest listing the
+	// plugin binaries available at BaseURL.
+	ChecksumsURL string
+
+	// SignatureURL is the location of a raw Ed25519 signature of the
+	// exact bytes served at ChecksumsURL. It must verify against
+	// PublicKey or Discover refuses to use the manifest.
+	SignatureURL string
+
+	// PublicKey verifies the signature at SignatureURL. It is required;
+	// Discover returns an error if it's unset, rather than silently
+	// trusting an unsigned manifest.
+	PublicKey ed25519.PublicKey
+
+	// CacheDir is the local directory downloaded plugins are stored in.
+	// It is created if it doesn't already exist.
+	CacheDir string
+
+	// Client is the HTTP client used to fetch the manifest, signature,
+	// and binaries. It defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Discover implements PluginSource.
+func (s *RegistrySource) Discover(c *Config) error {
+	if len(s.PublicKey) == 0 {
+		return fmt.Errorf(
+			"RegistrySource.PublicKey is required to verify %s", s.ChecksumsURL)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	manifest, err := s.fetchBytes(client, s.ChecksumsURL)
+	if err != nil {
+		return err
+	}
+
+	signature, err := s.fetchBytes(client, s.SignatureURL)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(s.PublicKey, manifest, signature) {
+		return fmt.Errorf(
+			"Error verifying checksums manifest %s: invalid signature", s.ChecksumsURL)
+	}
+
+	checksums, err := parseChecksums(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.CacheDir, 0755); err != nil {
+		return fmt.Errorf("Error creating plugin cache dir %s: %s", s.CacheDir, err)
+	}
+
+	for file, sum := range checksums {
+		if !safeManifestFilename(file) {
+			return fmt.Errorf(
+				"Error in checksums manifest %s: unsafe plugin filename %q", s.ChecksumsURL, file)
+		}
+
+		name, ok := pluginName(file)
+		if !ok {
+			continue
+		}
+
+		var m *map[string]string
+		switch {
+		case strings.HasPrefix(file, providerPrefix):
+			m = &c.Providers
+		case strings.HasPrefix(file, provisionerPrefix):
+			m = &c.Provisioners
+		default:
+			continue
+		}
+
+		cachePath := filepath.Join(s.CacheDir, file)
+		if err := s.ensureCached(client, file, sum, cachePath); err != nil {
+			return err
+		}
+
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+
+		c.logger().Debugf("Discovered plugin: %s = %s", name, cachePath)
+		(*m)[name] = cachePath
+	}
+
+	return nil
+}
+
+// fetchBytes downloads the full response body at url.
+func (s *RegistrySource) fetchBytes(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error fetching %s: %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", url, err)
+	}
+
+	return body, nil
+}
+
+// parseChecksums parses a SHA256 manifest (lines of "<sha256>  <filename>",
+// matching the output of sha256sum) into a map of filename to lowercase
+// hex-encoded checksum.
+func parseChecksums(manifest []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(manifest), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Error parsing checksums manifest: invalid line %q", line)
+		}
+
+		checksums[fields[1]] = strings.ToLower(fields[0])
+	}
+
+	return checksums, nil
+}
+
+// safeManifestFilename reports whether file, a filename taken verbatim from
+// a checksums manifest, is safe to join onto CacheDir. The manifest is
+// signed, but a signature only proves who produced it, not that every line
+// is a bare filename: a file field of "terraform-provider-../../../etc/cron.d/evil" would
+// otherwise survive pluginName's prefix/part-count check and let
+// ensureCached write through filepath.Join's ".." resolution to an
+// arbitrary path. Reject anything that isn't already its own base name.
+func safeManifestFilename(file string) bool {
+	return file != "" && !strings.Contains(file, "..") && filepath.Base(file) == file
+}
+
+// ensureCached makes sure file is present at cachePath with contents
+// matching sum, downloading it from BaseURL if it's missing or stale.
+func (s *RegistrySource) ensureCached(client *http.Client, file, sum, cachePath string) error {
+	if ok, _ := matchesChecksum(cachePath, sum); ok {
+		return nil
+	}
+
+	url := strings.TrimSuffix(s.BaseURL, "/") + "/" + path.Base(file)
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("Error downloading plugin %s: %s", file, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error downloading plugin %s: %s", file, resp.Status)
+	}
+
+	out, err := os.OpenFile(cachePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return fmt.Errorf("Error caching plugin %s: %s", file, err)
+	}
+	defer out.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		return fmt.Errorf("Error caching plugin %s: %s", file, err)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != sum {
+		os.Remove(cachePath)
+		return fmt.Errorf(
+			"checksum mismatch for %s: manifest says %s, downloaded %s", file, sum, actual)
+	}
+
+	return nil
+}
+
+// matchesChecksum reports whether the file at path already exists and its
+// SHA256 matches sum.
+func matchesChecksum(path, sum string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)) == sum, nil
+}
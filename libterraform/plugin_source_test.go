@@ -0,0 +1,321 @@
+package libterraform
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// registryFixture serves a signed checksums manifest and the plugin binary
+// it describes, suitable for exercising RegistrySource.Discover.
+type registryFixture struct {
+	server    *httptest.Server
+	pub       ed25519.PublicKey
+	priv      ed25519.PrivateKey
+	payload   []byte
+	sum       string
+	downloads int32
+}
+
+// newRegistryFixture starts a server with a single
+// "terraform-provider-test" binary whose contents are payload, and a
+// checksums manifest signed with a freshly generated Ed25519 key. It counts
+// binary downloads in f.downloads so tests can assert a warm cache is
+// reused instead of re-fetched.
+func newRegistryFixture(t *testing.T, payload []byte) *registryFixture {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &registryFixture{pub: pub, priv: priv, payload: payload}
+
+	sum := sha256Hex(payload)
+	manifest := []byte(sum + "  terraform-provider-test\n")
+	signature := ed25519.Sign(priv, manifest)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checksums", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(manifest)
+	})
+	mux.HandleFunc("/checksums.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signature)
+	})
+	mux.HandleFunc("/terraform-provider-test", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.downloads, 1)
+		w.Write(payload)
+	})
+
+	f.server = httptest.NewServer(mux)
+	f.sum = sum
+	return f
+}
+
+func (f *registryFixture) source(cacheDir string) *RegistrySource {
+	return &RegistrySource{
+		BaseURL:      f.server.URL,
+		ChecksumsURL: f.server.URL + "/checksums",
+		SignatureURL: f.server.URL + "/checksums.sig",
+		PublicKey:    f.pub,
+		CacheDir:     cacheDir,
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRegistrySourceDiscover(t *testing.T) {
+	fixture := newRegistryFixture(t, []byte("fake-provider-binary"))
+	defer fixture.server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "libterraform-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var c Config
+	if err := fixture.source(cacheDir).Discover(&c); err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+
+	path, ok := c.Providers["test"]
+	if !ok {
+		t.Fatal("Discover() did not register provider \"test\"")
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "fake-provider-binary" {
+		t.Errorf("cached plugin contents = %q, want %q", got, "fake-provider-binary")
+	}
+}
+
+func TestRegistrySourceDiscoverInvalidSignature(t *testing.T) {
+	fixture := newRegistryFixture(t, []byte("fake-provider-binary"))
+	defer fixture.server.Close()
+
+	// Sign with a different key than the one RegistrySource is told to
+	// trust, simulating a forged or corrupted signature.
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.pub = other
+
+	cacheDir, err := ioutil.TempDir("", "libterraform-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var c Config
+	err = fixture.source(cacheDir).Discover(&c)
+	if err == nil {
+		t.Fatal("Discover() with an invalid signature succeeded, want error")
+	}
+}
+
+func TestRegistrySourceDiscoverTamperedManifest(t *testing.T) {
+	fixture := newRegistryFixture(t, []byte("fake-provider-binary"))
+	defer fixture.server.Close()
+
+	// Serve a manifest that no longer matches what was signed.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checksums", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fixture.sum + "  terraform-provider-evil\n"))
+	})
+	mux.HandleFunc("/checksums.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ed25519.Sign(fixture.priv, []byte(fixture.sum+"  terraform-provider-test\n")))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "libterraform-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	source := &RegistrySource{
+		BaseURL:      server.URL,
+		ChecksumsURL: server.URL + "/checksums",
+		SignatureURL: server.URL + "/checksums.sig",
+		PublicKey:    fixture.pub,
+		CacheDir:     cacheDir,
+	}
+
+	var c Config
+	if err := source.Discover(&c); err == nil {
+		t.Fatal("Discover() with a tampered manifest succeeded, want error")
+	}
+}
+
+func TestRegistrySourceDiscoverChecksumMismatch(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign a manifest for "fake-provider-binary", but serve different
+	// bytes for the download, as if the binary were swapped out after
+	// the manifest was signed.
+	sum := sha256Hex([]byte("fake-provider-binary"))
+	manifest := []byte(sum + "  terraform-provider-test\n")
+	signature := ed25519.Sign(priv, manifest)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checksums", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(manifest)
+	})
+	mux.HandleFunc("/checksums.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signature)
+	})
+	mux.HandleFunc("/terraform-provider-test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tampered-after-signing"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "libterraform-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	source := &RegistrySource{
+		BaseURL:      server.URL,
+		ChecksumsURL: server.URL + "/checksums",
+		SignatureURL: server.URL + "/checksums.sig",
+		PublicKey:    pub,
+		CacheDir:     cacheDir,
+	}
+
+	var c Config
+	if err := source.Discover(&c); err == nil {
+		t.Fatal("Discover() with a checksum mismatch succeeded, want error")
+	}
+
+	if _, statErr := os.Stat(filepath.Join(cacheDir, "terraform-provider-test")); statErr == nil {
+		t.Error("Discover() left a mismatched download in the cache")
+	}
+}
+
+func TestRegistrySourceDiscoverCacheHit(t *testing.T) {
+	fixture := newRegistryFixture(t, []byte("fake-provider-binary"))
+	defer fixture.server.Close()
+
+	cacheDir, err := ioutil.TempDir("", "libterraform-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var c Config
+	source := fixture.source(cacheDir)
+	if err := source.Discover(&c); err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	if n := atomic.LoadInt32(&fixture.downloads); n != 1 {
+		t.Fatalf("downloads after first Discover() = %d, want 1", n)
+	}
+
+	var c2 Config
+	if err := source.Discover(&c2); err != nil {
+		t.Fatalf("Discover() with a warm cache error = %v", err)
+	}
+	if n := atomic.LoadInt32(&fixture.downloads); n != 1 {
+		t.Errorf("downloads after second Discover() = %d, want 1 (cache hit should skip the download)", n)
+	}
+}
+
+func TestParseChecksums(t *testing.T) {
+	cases := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "single line",
+			input: "AABBCC  terraform-provider-aws\n",
+			want:  map[string]string{"terraform-provider-aws": "aabbcc"},
+		},
+		{
+			name: "multiple lines with blank padding",
+			input: "\n" +
+				"aabbcc  terraform-provider-aws\n" +
+				"ddeeff  terraform-provisioner-local-exec\n" +
+				"\n",
+			want: map[string]string{
+				"terraform-provider-aws":           "aabbcc",
+				"terraform-provisioner-local-exec": "ddeeff",
+			},
+		},
+		{
+			name:    "malformed line",
+			input:   "not-a-valid-manifest-line\n",
+			wantErr: true,
+		},
+		{
+			name:    "too many fields",
+			input:   "aabbcc terraform-provider-aws extra\n",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseChecksums([]byte(c.input))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("parseChecksums(%q) succeeded, want error", c.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseChecksums(%q) error = %v", c.input, err)
+			}
+
+			if len(got) != len(c.want) {
+				t.Fatalf("parseChecksums(%q) = %v, want %v", c.input, got, c.want)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Errorf("parseChecksums(%q)[%q] = %q, want %q", c.input, k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestSafeManifestFilename(t *testing.T) {
+	cases := []struct {
+		file string
+		ok   bool
+	}{
+		{"terraform-provider-aws", true},
+		{"terraform-provider-aws_v1.2.3", true},
+		{"../../../../etc/cron.d/evil", false},
+		{"terraform-provider-../../../../tmp/evil", false},
+		{"sub/terraform-provider-aws", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if ok := safeManifestFilename(c.file); ok != c.ok {
+			t.Errorf("safeManifestFilename(%q) = %v, want %v", c.file, ok, c.ok)
+		}
+	}
+}